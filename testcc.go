@@ -5,15 +5,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+// taxCollectionName is the private data collection holding tax policy and
+// the Tax Authority's confidential balance, configured in collections_config.json
+const taxCollectionName = "taxCollection"
+
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
 }
@@ -26,6 +32,34 @@ type participant struct {
 	Balance  int    `json:"balance"`
 }
 
+// token describes the metadata of a named token, keyed by its symbol
+type token struct {
+	ObjectType  string `json:"docType"`
+	Symbol      string `json:"symbol"`
+	Name        string `json:"name"`
+	Owner       string `json:"owner"`
+	TotalSupply int    `json:"totalSupply"`
+	LockFlag    bool   `json:"lockFlag"`
+}
+
+// taxPolicy holds the confidential tax rate and exemption rules, stored only
+// in the taxCollection private data collection
+type taxPolicy struct {
+	ObjectType       string   `json:"docType"`
+	Rate             int      `json:"rate"` //whole percentage points, e.g. 2 for 2%
+	ExemptCategories []string `json:"exemptCategories"`
+}
+
+// account holds a single participant's balance of a single token, keyed by
+// the ("account", participant, symbol) composite key so one participant can
+// hold balances of many tokens side by side
+type account struct {
+	ObjectType  string `json:"docType"`
+	Participant string `json:"participant"`
+	Symbol      string `json:"symbol"`
+	Balance     int    `json:"balance"`
+}
+
 // ===================================================================================
 // Main
 // ===================================================================================
@@ -57,6 +91,32 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.transferPoints(stub, args)
 	} else if function == "readParty" { //read a Participant
 		return t.readParty(stub, args)
+	} else if function == "initToken" { //create a new named token
+		return t.initToken(stub, args)
+	} else if function == "mintToken" { //mint additional supply of a token to a participant
+		return t.mintToken(stub, args)
+	} else if function == "burnToken" { //burn token supply from a participant
+		return t.burnToken(stub, args)
+	} else if function == "transferToken" { //transfer a named token from one participant to another
+		return t.transferToken(stub, args)
+	} else if function == "getAccount" { //list all token balances held by a participant
+		return t.getAccount(stub, args)
+	} else if function == "setTaxPolicy" { //set the confidential tax rate and exemptions
+		return t.setTaxPolicy(stub, args)
+	} else if function == "readTaxPolicy" { //read the confidential tax policy
+		return t.readTaxPolicy(stub, args)
+	} else if function == "queryParticipantsByCategory" { //find participants of a given category
+		return t.queryParticipantsByCategory(stub, args)
+	} else if function == "queryParticipantsByBalanceRange" { //find participants with a balance between min and max
+		return t.queryParticipantsByBalanceRange(stub, args)
+	} else if function == "queryParticipants" { //run an ad-hoc CouchDB query string with pagination
+		return t.queryParticipants(stub, args)
+	} else if function == "getHistoryForParty" { //get the full change history of a Participant
+		return t.getHistoryForParty(stub, args)
+	} else if function == "setTaxRate" { //set just the tax rate, Tax Authority only
+		return t.setTaxRate(stub, args)
+	} else if function == "batchTransfer" { //transfer points across several legs atomically
+		return t.batchTransfer(stub, args)
 	}
 
 	fmt.Println("invoke did not find func: " + function) //error
@@ -75,6 +135,10 @@ func (t *SimpleChaincode) initParty(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Incorrect number of arguments. Expecting 3 (Name, Type, Balance)")
 	}
 
+	if err := authorize(stub, "admin"); err != nil {
+		return shim.Error("Not authorized to init a Participant: " + err.Error())
+	}
+
 	// ==== Input checking ====
 	fmt.Println("- start init participant")
 	if len(args[0]) <= 0 {
@@ -94,6 +158,40 @@ func (t *SimpleChaincode) initParty(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("3rd argument must be a numeric string")
 	}
 
+	// ==== Tax Authority's balance is confidential, so it lives in the private collection instead of public state ====
+	if category == "taxauth" {
+		taxAuthAsBytes, err := stub.GetPrivateData(taxCollectionName, partyName)
+		if err != nil {
+			return shim.Error("Failed to get Participant: " + err.Error())
+		} else if taxAuthAsBytes != nil {
+			fmt.Println("This Participant already exists: " + partyName)
+			return shim.Error("This Participant already exists: " + partyName)
+		}
+
+		objectType := "participant"
+		participant := &participant{objectType, partyName, category, balance}
+		partyJSONasBytes, err := json.Marshal(participant)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if err = stub.PutPrivateData(taxCollectionName, partyName, partyJSONasBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Leave a public, balance-free marker so getHistoryForParty(taxAuth) still has a timeline to walk.
+		if err = touchPublicMarker(stub, partyName, category); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if err = emitParticipantCreated(stub, partyName, category); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		fmt.Println("- end init participant")
+		return shim.Success(nil)
+	}
+
 	// ==== Check if Participant already exists ====
 	partyAsBytes, err := stub.GetState(partyName)
 	if err != nil {
@@ -117,6 +215,10 @@ func (t *SimpleChaincode) initParty(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error(err.Error())
 	}
 
+	if err = emitParticipantCreated(stub, partyName, category); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// ==== Participant saved. Return success ====
 	fmt.Println("- end init participant")
 	return shim.Success(nil)
@@ -162,8 +264,17 @@ func (t *SimpleChaincode) transferPoints(stub shim.ChaincodeStubInterface, args
 	points := args[2]
 	taxAuth := "TaxAuth"
 
+	if err := authorizeSender(stub, sender); err != nil {
+		return shim.Error("Not authorized to transfer from " + sender + ": " + err.Error())
+	}
+
 	pointsAsInt, err := strconv.Atoi(points)
-	// need to check for err
+	if err != nil {
+		return shim.Error("3rd argument must be a numeric string")
+	}
+	if pointsAsInt <= 0 {
+		return shim.Error("3rd argument must be a positive amount")
+	}
 
 	fmt.Println("- start Points Transfer ", sender, receiver, points)
 
@@ -183,14 +294,20 @@ func (t *SimpleChaincode) transferPoints(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Receiver does not exist")
 	}
 
-	// Get the Tax_Authority object.
-	taxAuthAsBytes, err := stub.GetState(taxAuth)
+	// Get the Tax_Authority object from the private collection.
+	taxAuthAsBytes, err := stub.GetPrivateData(taxCollectionName, taxAuth)
 	if err != nil {
 		return shim.Error("Failed to get Tax_Authority:" + err.Error())
-	} else if senderAsBytes == nil {
+	} else if taxAuthAsBytes == nil {
 		return shim.Error("Tax Authority does not exist")
 	}
 
+	// Read the tax rate from the confidential tax policy, defaulting to 2% if unset.
+	taxRate, err := getTaxRate(stub)
+	if err != nil {
+		return shim.Error("Failed to get tax policy:" + err.Error())
+	}
+
 	// convert Tax Authority to json
 	taxAuthority := participant{}
 	err = json.Unmarshal(taxAuthAsBytes, &taxAuthority)
@@ -212,9 +329,10 @@ func (t *SimpleChaincode) transferPoints(stub shim.ChaincodeStubInterface, args
 	}
 
 	// check if sender or receiver of type Tax-Auth => Terminate the transaction.
-	if senderTransfer.Category == "TaxAuth" {
+	// Category is stored lowercased (see strings.ToLower in initParty), so compare against "taxauth".
+	if senderTransfer.Category == "taxauth" {
 		return shim.Error("Tax Authority cann't Participate in any transaction")
-	} else if receiverTranfer.Category == "TaxAuth" {
+	} else if receiverTranfer.Category == "taxauth" {
 		return shim.Error("Tax Authority cann't Participate in any transaction")
 	}
 
@@ -226,12 +344,15 @@ func (t *SimpleChaincode) transferPoints(stub shim.ChaincodeStubInterface, args
 	// withdraw the points from sender account
 	senderTransfer.Balance = senderTransfer.Balance - pointsAsInt //withdraw the points from sender account
 
+	taxPoints := 0
+	var collected *taxCollectedEvent
+
 	// Check receiver type to calculate the taxes
 	if receiverTranfer.Category == "TaxExempt" {
 		receiverTranfer.Balance = receiverTranfer.Balance + pointsAsInt // credit the points to Receiver account with no taxex
 	} else {
-		//calculate tax amount.
-		taxPoints := (pointsAsInt * 2) / 100
+		//calculate tax amount using the confidential tax rate.
+		taxPoints = (pointsAsInt * taxRate) / 100
 		pointsAfterTax := pointsAsInt - taxPoints
 
 		//transfer points to receiver after cutting the tax amount.
@@ -240,13 +361,19 @@ func (t *SimpleChaincode) transferPoints(stub shim.ChaincodeStubInterface, args
 		//tranfer the tax to tax authority.
 		taxAuthority.Balance = taxAuthority.Balance + taxPoints
 
-		// Save the new values to the chain
+		// Save the new values to the private collection
 		authorityJSONasBytes, _ := json.Marshal(taxAuthority)
-		err = stub.PutState(taxAuth, authorityJSONasBytes) //rewrite the Tax Authority with the new balance.
+		err = stub.PutPrivateData(taxCollectionName, taxAuth, authorityJSONasBytes) //rewrite the Tax Authority with the new balance.
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 
+		// Leave a public, balance-free marker so getHistoryForParty(taxAuth) still has a timeline to walk.
+		if err = touchPublicMarker(stub, taxAuth, taxAuthority.Category); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		collected = &taxCollectedEvent{sender, taxPoints, stub.GetTxID()}
 	}
 
 	// Save the new values to the chain
@@ -262,7 +389,1011 @@ func (t *SimpleChaincode) transferPoints(stub shim.ChaincodeStubInterface, args
 		return shim.Error(err.Error())
 	}
 
+	// SetEvent only keeps the last call per transaction, so the transfer and any tax
+	// collection are folded into a single composite event instead of two separate calls.
+	transferred := pointsTransferredEvent{sender, receiver, pointsAsInt, taxPoints, pointsAsInt - taxPoints, stub.GetTxID()}
+	if err = emitTransfer(stub, transferred, collected); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	fmt.Println("- end transferPoints (success)")
 	return shim.Success(nil)
 
 }
+
+// ===========================================================================================================
+// accountKey - build the composite key for a participant's balance of a given token symbol
+// ===========================================================================================================
+func accountKey(stub shim.ChaincodeStubInterface, participantName string, symbol string) (string, error) {
+	return stub.CreateCompositeKey("account", []string{participantName, symbol})
+}
+
+// ===========================================================================================================
+// getAccountBalance - fetch (and unmarshal) a participant's account record for a token, if any
+// ===========================================================================================================
+func getAccountBalance(stub shim.ChaincodeStubInterface, participantName string, symbol string) (*account, error) {
+	key, err := accountKey(stub, participantName, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	accountAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+
+	acct := &account{"account", participantName, symbol, 0}
+	if accountAsBytes != nil {
+		if err := json.Unmarshal(accountAsBytes, acct); err != nil {
+			return nil, err
+		}
+	}
+
+	return acct, nil
+}
+
+// ===========================================================================================================
+// putAccountBalance - marshal and save a participant's account record for a token
+// ===========================================================================================================
+func putAccountBalance(stub shim.ChaincodeStubInterface, acct *account) error {
+	key, err := accountKey(stub, acct.Participant, acct.Symbol)
+	if err != nil {
+		return err
+	}
+
+	acctJSONasBytes, err := json.Marshal(acct)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(key, acctJSONasBytes)
+}
+
+// ===========================================================================================================
+// initToken - create a new named token, store its metadata into chaincode state
+// ===========================================================================================================
+func (t *SimpleChaincode) initToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//     0         1        2          3
+	// "symbol", "name", "owner", "totalSupply"
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 (Symbol, Name, Owner, TotalSupply)")
+	}
+
+	fmt.Println("- start init token")
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+
+	symbol := strings.ToUpper(args[0])
+	tokenName := args[1]
+	owner := args[2]
+	totalSupply, err := strconv.Atoi(args[3])
+	if err != nil {
+		return shim.Error("4th argument must be a numeric string")
+	}
+
+	tokenKey, err := stub.CreateCompositeKey("token", []string{symbol})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tokenAsBytes, err := stub.GetState(tokenKey)
+	if err != nil {
+		return shim.Error("Failed to get Token: " + err.Error())
+	} else if tokenAsBytes != nil {
+		fmt.Println("This Token already exists: " + symbol)
+		return shim.Error("This Token already exists: " + symbol)
+	}
+
+	tok := &token{"token", symbol, tokenName, owner, totalSupply, false}
+	tokenJSONasBytes, err := json.Marshal(tok)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = stub.PutState(tokenKey, tokenJSONasBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Credit the full supply to the owner's account ====
+	ownerAccount, err := getAccountBalance(stub, owner, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ownerAccount.Balance += totalSupply
+	if err = putAccountBalance(stub, ownerAccount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end init token")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================================
+// mintToken - increase a token's total supply and credit the new supply to a participant's account
+// ===========================================================================================================
+func (t *SimpleChaincode) mintToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//     0         1       2
+	// "symbol", "amount", "to"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 (Symbol, Amount, To)")
+	}
+
+	symbol := strings.ToUpper(args[0])
+	amount, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
+	if amount <= 0 {
+		return shim.Error("2nd argument must be a positive amount")
+	}
+	to := args[2]
+
+	tokenKey, err := stub.CreateCompositeKey("token", []string{symbol})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tokenAsBytes, err := stub.GetState(tokenKey)
+	if err != nil {
+		return shim.Error("Failed to get Token: " + err.Error())
+	} else if tokenAsBytes == nil {
+		return shim.Error("Token does not exist: " + symbol)
+	}
+
+	tok := token{}
+	if err = json.Unmarshal(tokenAsBytes, &tok); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = authorizeSender(stub, tok.Owner); err != nil {
+		return shim.Error("Not authorized to mint token " + symbol + ": " + err.Error())
+	}
+
+	if tok.LockFlag {
+		return shim.Error("Token is locked: " + symbol)
+	}
+
+	tok.TotalSupply += amount
+	tokenJSONasBytes, err := json.Marshal(tok)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.PutState(tokenKey, tokenJSONasBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	toAccount, err := getAccountBalance(stub, to, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	toAccount.Balance += amount
+	if err = putAccountBalance(stub, toAccount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ===========================================================================================================
+// burnToken - decrease a token's total supply by removing it from a participant's account
+// ===========================================================================================================
+func (t *SimpleChaincode) burnToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//     0         1        2
+	// "symbol", "amount", "from"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 (Symbol, Amount, From)")
+	}
+
+	symbol := strings.ToUpper(args[0])
+	amount, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
+	if amount <= 0 {
+		return shim.Error("2nd argument must be a positive amount")
+	}
+	from := args[2]
+
+	tokenKey, err := stub.CreateCompositeKey("token", []string{symbol})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tokenAsBytes, err := stub.GetState(tokenKey)
+	if err != nil {
+		return shim.Error("Failed to get Token: " + err.Error())
+	} else if tokenAsBytes == nil {
+		return shim.Error("Token does not exist: " + symbol)
+	}
+
+	tok := token{}
+	if err = json.Unmarshal(tokenAsBytes, &tok); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = authorizeSender(stub, tok.Owner); err != nil {
+		return shim.Error("Not authorized to burn token " + symbol + ": " + err.Error())
+	}
+
+	fromAccount, err := getAccountBalance(stub, from, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if fromAccount.Balance < amount {
+		return shim.Error("There is not enough balance in the account to burn")
+	}
+	fromAccount.Balance -= amount
+	if err = putAccountBalance(stub, fromAccount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tok.TotalSupply -= amount
+	tokenJSONasBytes, err := json.Marshal(tok)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.PutState(tokenKey, tokenJSONasBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ===========================================================================================================
+// transferToken - transfer a named token from one participant's account to another's
+// ===========================================================================================================
+func (t *SimpleChaincode) transferToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//     0        1       2        3
+	// "symbol", "from", "to", "amount"
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 (Symbol, From, To, Amount)")
+	}
+
+	symbol := strings.ToUpper(args[0])
+	from := args[1]
+	to := args[2]
+	amount, err := strconv.Atoi(args[3])
+	if err != nil {
+		return shim.Error("4th argument must be a numeric string")
+	}
+	if amount <= 0 {
+		return shim.Error("4th argument must be a positive amount")
+	}
+
+	if err := authorizeSender(stub, from); err != nil {
+		return shim.Error("Not authorized to transfer token " + symbol + " from " + from + ": " + err.Error())
+	}
+
+	fmt.Println("- start Token Transfer ", symbol, from, to, amount)
+
+	tokenKey, err := stub.CreateCompositeKey("token", []string{symbol})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenAsBytes, err := stub.GetState(tokenKey)
+	if err != nil {
+		return shim.Error("Failed to get Token: " + err.Error())
+	} else if tokenAsBytes == nil {
+		return shim.Error("Token does not exist: " + symbol)
+	}
+	tok := token{}
+	if err = json.Unmarshal(tokenAsBytes, &tok); err != nil {
+		return shim.Error(err.Error())
+	}
+	if tok.LockFlag {
+		return shim.Error("Token is locked: " + symbol)
+	}
+
+	fromAccount, err := getAccountBalance(stub, from, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if fromAccount.Balance < amount {
+		return shim.Error("There is no enough balance in the sender account")
+	}
+
+	toAccount, err := getAccountBalance(stub, to, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fromAccount.Balance -= amount
+	toAccount.Balance += amount
+
+	if err = putAccountBalance(stub, fromAccount); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = putAccountBalance(stub, toAccount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transferToken (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================================
+// getAccount - enumerate all token balances held by a participant using a partial composite key query
+// ===========================================================================================================
+func (t *SimpleChaincode) getAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting name of the Participant to query")
+	}
+
+	participantName := args[0]
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("account", []string{participantName})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	first := true
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if !first {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(string(responseRange.Value))
+		first = false
+	}
+	buffer.WriteString("]")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================================================
+// callerMSPID - extract the MSP ID of the identity that submitted the current transaction
+// ===========================================================================================================
+func callerMSPID(stub shim.ChaincodeStubInterface) (string, error) {
+	return cid.GetMSPID(stub)
+}
+
+// ===========================================================================================================
+// authorize - require that the caller's X.509 certificate carries every one of the given attributes set to "true"
+// ===========================================================================================================
+func authorize(stub shim.ChaincodeStubInterface, requiredAttrs ...string) error {
+	for _, attr := range requiredAttrs {
+		value, found, err := cid.GetAttributeValue(stub, attr)
+		if err != nil {
+			return err
+		}
+		if !found || value != "true" {
+			return fmt.Errorf("caller is missing required attribute: %s", attr)
+		}
+	}
+	return nil
+}
+
+// ===========================================================================================================
+// authorizeSender - require that the caller is the "from" account itself, or holds a "delegate" attribute for it
+// ===========================================================================================================
+func authorizeSender(stub shim.ChaincodeStubInterface, from string) error {
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return err
+	}
+	if cert.Subject.CommonName == from {
+		return nil
+	}
+
+	delegateFor, found, err := cid.GetAttributeValue(stub, "delegate")
+	if err != nil {
+		return err
+	}
+	if found && delegateFor == from {
+		return nil
+	}
+
+	return fmt.Errorf("caller is not authorized to act on behalf of %s", from)
+}
+
+// ===========================================================================================================
+// getTaxRate - read the tax rate from the confidential tax policy, defaulting to 2% if it has not been set
+// ===========================================================================================================
+func getTaxRate(stub shim.ChaincodeStubInterface) (int, error) {
+	policyAsBytes, err := stub.GetPrivateData(taxCollectionName, "taxPolicy")
+	if err != nil {
+		return 0, err
+	}
+	if policyAsBytes == nil {
+		return 2, nil
+	}
+
+	policy := taxPolicy{}
+	if err = json.Unmarshal(policyAsBytes, &policy); err != nil {
+		return 0, err
+	}
+	return policy.Rate, nil
+}
+
+// ===========================================================================================================
+// setTaxPolicy - set the confidential tax rate and exempt categories, restricted to the Tax Authority's MSP
+// ===========================================================================================================
+func (t *SimpleChaincode) setTaxPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//     0        1...
+	// "rate", "exemptCategories"...
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 1 (Rate, [ExemptCategories...])")
+	}
+
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	if mspID != "TaxAuthMSP" {
+		return shim.Error("Only the Tax Authority's organization may set the tax policy")
+	}
+
+	rate, err := strconv.Atoi(args[0])
+	if err != nil {
+		return shim.Error("1st argument must be a numeric string")
+	}
+
+	exemptCategories := make([]string, 0, len(args)-1)
+	for _, category := range args[1:] {
+		exemptCategories = append(exemptCategories, strings.ToLower(category))
+	}
+
+	policy := &taxPolicy{"taxPolicy", rate, exemptCategories}
+	policyJSONasBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = stub.PutPrivateData(taxCollectionName, "taxPolicy", policyJSONasBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ===========================================================================================================
+// constructQueryResponseFromIterator - builds a JSON array of query results from a result iterator
+// ===========================================================================================================
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	first := true
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(string(queryResponse.Value))
+		first = false
+	}
+	buffer.WriteString("]")
+
+	return &buffer, nil
+}
+
+// ===========================================================================================================
+// getQueryResultForQueryString - executes a CouchDB query string and returns the matching results
+// ===========================================================================================================
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ===========================================================================================================
+// readTaxPolicy - read the confidential tax policy from the private collection
+// ===========================================================================================================
+func (t *SimpleChaincode) readTaxPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	if mspID != "TaxAuthMSP" {
+		return shim.Error("Only the Tax Authority's organization may read the tax policy")
+	}
+
+	policyAsBytes, err := stub.GetPrivateData(taxCollectionName, "taxPolicy")
+	if err != nil {
+		return shim.Error("Failed to get tax policy: " + err.Error())
+	} else if policyAsBytes == nil {
+		return shim.Error("Tax policy has not been set")
+	}
+
+	return shim.Success(policyAsBytes)
+}
+
+// ===========================================================================================================
+// setTaxRate - update just the tax rate on the existing tax policy, restricted to the Tax Authority's MSP
+// ===========================================================================================================
+func (t *SimpleChaincode) setTaxRate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (Rate)")
+	}
+
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	if mspID != "TaxAuthMSP" {
+		return shim.Error("Only the Tax Authority's organization may set the tax rate")
+	}
+
+	rate, err := strconv.Atoi(args[0])
+	if err != nil {
+		return shim.Error("1st argument must be a numeric string")
+	}
+
+	policy := taxPolicy{ObjectType: "taxPolicy"}
+	policyAsBytes, err := stub.GetPrivateData(taxCollectionName, "taxPolicy")
+	if err != nil {
+		return shim.Error("Failed to get tax policy: " + err.Error())
+	} else if policyAsBytes != nil {
+		if err = json.Unmarshal(policyAsBytes, &policy); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	policy.Rate = rate
+
+	updatedPolicyAsBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = stub.PutPrivateData(taxCollectionName, "taxPolicy", updatedPolicyAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// batchLeg is a single transfer within a batchTransfer payload
+type batchLeg struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Amount     int    `json:"amount"`
+	Memo       string `json:"memo"`
+	ClientTxID string `json:"clientTxId"`
+}
+
+// ===========================================================================================================
+// processedTxKey - composite key tracking which client transaction IDs have already been applied
+// ===========================================================================================================
+func processedTxKey(stub shim.ChaincodeStubInterface, clientTxID string) (string, error) {
+	return stub.CreateCompositeKey("processedTx", []string{clientTxID})
+}
+
+// ===========================================================================================================
+// batchTransfer - apply a batch of point transfers atomically, rejecting the whole batch if any leg is invalid
+// ===========================================================================================================
+func (t *SimpleChaincode) batchTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (PayloadJSON)")
+	}
+
+	var legs []batchLeg
+	if err := json.Unmarshal([]byte(args[0]), &legs); err != nil {
+		return shim.Error("Failed to parse batch payload: " + err.Error())
+	}
+	if len(legs) == 0 {
+		return shim.Error("Batch payload must contain at least one transfer")
+	}
+
+	taxAuth := "TaxAuth"
+	taxRate, err := getTaxRate(stub)
+	if err != nil {
+		return shim.Error("Failed to get tax policy: " + err.Error())
+	}
+
+	taxAuthAsBytes, err := stub.GetPrivateData(taxCollectionName, taxAuth)
+	if err != nil {
+		return shim.Error("Failed to get Tax_Authority:" + err.Error())
+	} else if taxAuthAsBytes == nil {
+		return shim.Error("Tax Authority does not exist")
+	}
+	taxAuthority := participant{}
+	if err = json.Unmarshal(taxAuthAsBytes, &taxAuthority); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Validate every leg against a running view of balances before applying anything ====
+	parties := make(map[string]*participant)
+	seenClientTxIDs := make(map[string]bool)
+	taxCollected := 0
+
+	loadParty := func(name string) (*participant, error) {
+		if party, ok := parties[name]; ok {
+			return party, nil
+		}
+		partyAsBytes, err := stub.GetState(name)
+		if err != nil {
+			return nil, err
+		}
+		if partyAsBytes == nil {
+			return nil, fmt.Errorf("participant does not exist: %s", name)
+		}
+		party := &participant{}
+		if err = json.Unmarshal(partyAsBytes, party); err != nil {
+			return nil, err
+		}
+		parties[name] = party
+		return party, nil
+	}
+
+	for _, leg := range legs {
+		if leg.ClientTxID == "" {
+			return shim.Error("Every leg must carry a clientTxId")
+		}
+		if seenClientTxIDs[leg.ClientTxID] {
+			return shim.Error("Duplicate clientTxId within batch: " + leg.ClientTxID)
+		}
+		seenClientTxIDs[leg.ClientTxID] = true
+
+		key, err := processedTxKey(stub, leg.ClientTxID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		processedAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if processedAsBytes != nil {
+			return shim.Error("clientTxId has already been processed: " + leg.ClientTxID)
+		}
+
+		if err = authorizeSender(stub, leg.From); err != nil {
+			return shim.Error("Not authorized to transfer from " + leg.From + ": " + err.Error())
+		}
+
+		sender, err := loadParty(leg.From)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		receiver, err := loadParty(leg.To)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Category is stored lowercased (see strings.ToLower in initParty), so compare against "taxauth".
+		if sender.Category == "taxauth" || receiver.Category == "taxauth" {
+			return shim.Error("Tax Authority cann't Participate in any transaction")
+		}
+		if leg.Amount <= 0 {
+			return shim.Error("Leg amount must be positive: " + leg.From + " -> " + leg.To)
+		}
+		if sender.Balance < leg.Amount {
+			return shim.Error("There is no enough balance in the sender account: " + leg.From)
+		}
+
+		sender.Balance -= leg.Amount
+		if receiver.Category == "taxexempt" {
+			receiver.Balance += leg.Amount
+		} else {
+			legTax := (leg.Amount * taxRate) / 100
+			receiver.Balance += leg.Amount - legTax
+			taxCollected += legTax
+		}
+	}
+
+	// ==== Every leg validated, now apply the mutations and mark the batch processed ====
+	for name, party := range parties {
+		partyJSONasBytes, err := json.Marshal(party)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err = stub.PutState(name, partyJSONasBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	var collected *taxCollectedEvent
+	if taxCollected > 0 {
+		taxAuthority.Balance += taxCollected
+		authorityJSONasBytes, err := json.Marshal(taxAuthority)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err = stub.PutPrivateData(taxCollectionName, taxAuth, authorityJSONasBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Leave a public, balance-free marker so getHistoryForParty(taxAuth) still has a timeline to walk.
+		if err = touchPublicMarker(stub, taxAuth, taxAuthority.Category); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		collected = &taxCollectedEvent{"batch", taxCollected, stub.GetTxID()}
+	}
+
+	transfers := make([]pointsTransferredEvent, 0, len(legs))
+	for _, leg := range legs {
+		key, err := processedTxKey(stub, leg.ClientTxID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err = stub.PutState(key, []byte(leg.ClientTxID)); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		legTax := 0
+		if parties[leg.To].Category != "taxexempt" {
+			legTax = (leg.Amount * taxRate) / 100
+		}
+		transfers = append(transfers, pointsTransferredEvent{leg.From, leg.To, leg.Amount, legTax, leg.Amount - legTax, stub.GetTxID()})
+	}
+
+	// SetEvent only keeps the last call per transaction, so every leg and any aggregated tax
+	// collection are folded into a single composite event instead of one SetEvent call each.
+	if err = emitBatchTransfer(stub, transfers, collected); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ===========================================================================================================
+// queryParticipantsByCategory - find all participants of a given category
+// ===========================================================================================================
+func (t *SimpleChaincode) queryParticipantsByCategory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting category")
+	}
+
+	category := strings.ToLower(args[0])
+
+	selector := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"docType":  "participant",
+			"category": category,
+		},
+	}
+	queryStringAsBytes, err := json.Marshal(selector)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryString(stub, string(queryStringAsBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(queryResults)
+}
+
+// ===========================================================================================================
+// queryParticipantsByBalanceRange - find all participants with a balance between min and max (inclusive)
+// ===========================================================================================================
+func (t *SimpleChaincode) queryParticipantsByBalanceRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting min and max balance")
+	}
+
+	min, err := strconv.Atoi(args[0])
+	if err != nil {
+		return shim.Error("1st argument must be a numeric string")
+	}
+	max, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
+
+	queryString := fmt.Sprintf(`{"selector":{"docType":"participant","balance":{"$gte":%d,"$lte":%d}}}`, min, max)
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(queryResults)
+}
+
+// ===========================================================================================================
+// queryParticipants - run an arbitrary CouchDB query string with pagination, returning the next bookmark
+// ===========================================================================================================
+func (t *SimpleChaincode) queryParticipants(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//          0                1          2
+	// "couchQueryString", "pageSize", "bookmark"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 (CouchQueryString, PageSize, Bookmark)")
+	}
+
+	queryString := args[0]
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
+	bookmark := args[2]
+
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	type paginatedResponse struct {
+		Results        json.RawMessage `json:"results"`
+		Bookmark       string          `json:"bookmark"`
+		FetchedRecords int32           `json:"fetchedRecordsCount"`
+	}
+
+	response := paginatedResponse{
+		Results:        json.RawMessage(buffer.Bytes()),
+		Bookmark:       responseMetadata.Bookmark,
+		FetchedRecords: responseMetadata.FetchedRecordsCount,
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// participantCreatedEvent is the payload of the ParticipantCreated chaincode event
+type participantCreatedEvent struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+// pointsTransferredEvent is the payload of the PointsTransferred chaincode event
+type pointsTransferredEvent struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Gross int    `json:"gross"`
+	Tax   int    `json:"tax"`
+	Net   int    `json:"net"`
+	TxID  string `json:"txId"`
+}
+
+// taxCollectedEvent is the payload of the TaxCollected chaincode event
+type taxCollectedEvent struct {
+	From   string `json:"from"`
+	Amount int    `json:"amount"`
+	TxID   string `json:"txId"`
+}
+
+// transferEvent folds a PointsTransferred notification and its optional TaxCollected
+// notification into one payload, since stub.SetEvent only delivers the last call made
+// in a transaction.
+type transferEvent struct {
+	PointsTransferred pointsTransferredEvent `json:"pointsTransferred"`
+	TaxCollected      *taxCollectedEvent     `json:"taxCollected,omitempty"`
+}
+
+// ===========================================================================================================
+// emitTransfer - emit a single PointsTransferred event carrying any tax collection alongside it
+// ===========================================================================================================
+func emitTransfer(stub shim.ChaincodeStubInterface, transferred pointsTransferredEvent, collected *taxCollectedEvent) error {
+	payload, err := json.Marshal(transferEvent{transferred, collected})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent("PointsTransferred", payload)
+}
+
+// ===========================================================================================================
+// emitParticipantCreated - emit the ParticipantCreated chaincode event
+// ===========================================================================================================
+func emitParticipantCreated(stub shim.ChaincodeStubInterface, name string, category string) error {
+	payload, err := json.Marshal(participantCreatedEvent{name, category})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent("ParticipantCreated", payload)
+}
+
+// batchTransferEvent folds every leg of a batchTransfer and its optional aggregated TaxCollected
+// notification into one payload, since stub.SetEvent only delivers the last call made in a transaction.
+type batchTransferEvent struct {
+	Transfers    []pointsTransferredEvent `json:"transfers"`
+	TaxCollected *taxCollectedEvent       `json:"taxCollected,omitempty"`
+}
+
+// ===========================================================================================================
+// emitBatchTransfer - emit a single BatchTransferred event carrying every leg and any aggregated tax
+// ===========================================================================================================
+func emitBatchTransfer(stub shim.ChaincodeStubInterface, transfers []pointsTransferredEvent, collected *taxCollectedEvent) error {
+	payload, err := json.Marshal(batchTransferEvent{transfers, collected})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent("BatchTransferred", payload)
+}
+
+// ===========================================================================================================
+// touchPublicMarker - write a balance-free public stub for a privately-held participant, so
+// stub.GetHistoryForKey (which only indexes public world state) still has a timeline to walk
+// ===========================================================================================================
+func touchPublicMarker(stub shim.ChaincodeStubInterface, name string, category string) error {
+	marker := &participant{"participant", name, category, 0}
+	markerAsBytes, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(name, markerAsBytes)
+}
+
+// historyEntry is one entry in a participant's balance timeline
+type historyEntry struct {
+	TxID      string       `json:"txId"`
+	Timestamp int64        `json:"timestamp"`
+	IsDelete  bool         `json:"isDelete"`
+	Value     *participant `json:"value,omitempty"`
+}
+
+// ===========================================================================================================
+// getHistoryForParty - return the full timeline of a participant's balance changes
+// For a participant held in the private collection (the Tax Authority) only its public marker is
+// recorded, so every entry shows a balance of 0 rather than its private balance.
+// ===========================================================================================================
+func (t *SimpleChaincode) getHistoryForParty(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting name of the Participant to query")
+	}
+
+	partyName := args[0]
+
+	resultsIterator, err := stub.GetHistoryForKey(partyName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var history []historyEntry
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		entry := historyEntry{
+			TxID:      modification.TxId,
+			Timestamp: modification.Timestamp.GetSeconds(),
+			IsDelete:  modification.IsDelete,
+		}
+
+		if !modification.IsDelete {
+			party := &participant{}
+			if err = json.Unmarshal(modification.Value, party); err != nil {
+				return shim.Error(err.Error())
+			}
+			entry.Value = party
+		}
+
+		history = append(history, entry)
+	}
+
+	historyAsBytes, err := json.Marshal(history)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(historyAsBytes)
+}
@@ -0,0 +1,196 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// attrsOID is the certificate extension OID fabric-ca embeds attributes under
+var attrsOID = []int{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// fabricatedIdentity builds a self-signed X.509 identity carrying the given
+// CommonName and fabric-ca style attributes, serialized the way cid expects
+// a transaction creator to look.
+func fabricatedIdentity(t *testing.T, mspID string, commonName string, attrs map[string]string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	attrsJSON, err := json.Marshal(struct {
+		Attrs map[string]string `json:"attrs"`
+	}{attrs})
+	if err != nil {
+		t.Fatalf("failed to marshal attrs: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: attrsOID, Value: attrsJSON},
+		},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	identity := &msp.SerializedIdentity{Mspid: mspID, IdBytes: certPEM}
+	identityBytes, err := proto.Marshal(identity)
+	if err != nil {
+		t.Fatalf("failed to marshal identity: %s", err)
+	}
+
+	return identityBytes
+}
+
+func TestInitPartyRequiresAdminAttribute(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{})
+
+	res := stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	if res.Status == shim.OK {
+		t.Fatalf("expected initParty to be rejected without the admin attribute")
+	}
+}
+
+func TestInitPartySucceedsWithAdminAttribute(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	res := stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	if res.Status != shim.OK {
+		t.Fatalf("expected initParty to succeed for an admin identity, got: %s", res.Message)
+	}
+}
+
+func TestTransferPointsRejectsMismatchedSender(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	admin := fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	stub.Creator = admin
+	stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	stub.MockInvoke("tx2", [][]byte{[]byte("initParty"), []byte("B"), []byte("normal"), []byte("0")})
+
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "mallory", map[string]string{})
+	res := stub.MockInvoke("tx3", [][]byte{[]byte("transferPoints"), []byte("A"), []byte("B"), []byte("100")})
+	if res.Status == shim.OK {
+		t.Fatalf("expected transferPoints to reject a caller who is neither the sender nor a delegate")
+	}
+}
+
+func TestTransferPointsAllowsDelegate(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	admin := fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	stub.Creator = admin
+	stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	stub.MockInvoke("tx2", [][]byte{[]byte("initParty"), []byte("B"), []byte("normal"), []byte("0")})
+	stub.MockInvoke("tx3", [][]byte{[]byte("initParty"), []byte("TaxAuth"), []byte("taxauth"), []byte("0")})
+
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "delegate-for-A", map[string]string{"delegate": "A"})
+	res := stub.MockInvoke("tx4", [][]byte{[]byte("transferPoints"), []byte("A"), []byte("B"), []byte("100")})
+	if res.Status != shim.OK {
+		t.Fatalf("expected transferPoints to allow a delegate acting for the sender, got: %s", res.Message)
+	}
+}
+
+func TestTransferPointsRejectsTaxAuthCounterparty(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	admin := fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	stub.Creator = admin
+	stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	stub.MockInvoke("tx2", [][]byte{[]byte("initParty"), []byte("TaxAuth"), []byte("taxauth"), []byte("0")})
+
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "A", map[string]string{})
+	res := stub.MockInvoke("tx3", [][]byte{[]byte("transferPoints"), []byte("A"), []byte("TaxAuth"), []byte("100")})
+	if res.Status == shim.OK {
+		t.Fatalf("expected transferPoints to reject a transfer to the Tax Authority's public marker")
+	}
+}
+
+func TestTransferPointsRejectsNonPositiveAmount(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	admin := fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	stub.Creator = admin
+	stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	stub.MockInvoke("tx2", [][]byte{[]byte("initParty"), []byte("B"), []byte("normal"), []byte("0")})
+
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "A", map[string]string{})
+	res := stub.MockInvoke("tx3", [][]byte{[]byte("transferPoints"), []byte("A"), []byte("B"), []byte("-100")})
+	if res.Status == shim.OK {
+		t.Fatalf("expected transferPoints to reject a negative amount")
+	}
+}
+
+func TestTransferTokenRejectsNonPositiveAmount(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	admin := fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	stub.Creator = admin
+	stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("0")})
+	stub.MockInvoke("tx2", [][]byte{[]byte("initParty"), []byte("B"), []byte("normal"), []byte("0")})
+
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "A", map[string]string{})
+	stub.MockInvoke("tx3", [][]byte{[]byte("initToken"), []byte("PTS"), []byte("Points"), []byte("A"), []byte("1000")})
+
+	res := stub.MockInvoke("tx4", [][]byte{[]byte("transferToken"), []byte("PTS"), []byte("A"), []byte("B"), []byte("-100")})
+	if res.Status == shim.OK {
+		t.Fatalf("expected transferToken to reject a negative amount rather than draining the counterparty")
+	}
+}
+
+func TestBatchTransferRejectsTaxAuthLeg(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	admin := fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	stub.Creator = admin
+	stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	stub.MockInvoke("tx2", [][]byte{[]byte("initParty"), []byte("TaxAuth"), []byte("taxauth"), []byte("0")})
+
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "A", map[string]string{})
+	payload := `[{"from":"A","to":"TaxAuth","amount":100,"clientTxId":"batch-tx-1"}]`
+	res := stub.MockInvoke("tx3", [][]byte{[]byte("batchTransfer"), []byte(payload)})
+	if res.Status == shim.OK {
+		t.Fatalf("expected batchTransfer to reject a leg crediting the Tax Authority's public marker")
+	}
+}
+
+func TestBatchTransferRejectsNonPositiveLegAmount(t *testing.T) {
+	stub := shim.NewMockStub("testcc", new(SimpleChaincode))
+	admin := fabricatedIdentity(t, "Org1MSP", "alice", map[string]string{"admin": "true"})
+
+	stub.Creator = admin
+	stub.MockInvoke("tx1", [][]byte{[]byte("initParty"), []byte("A"), []byte("normal"), []byte("500")})
+	stub.MockInvoke("tx2", [][]byte{[]byte("initParty"), []byte("B"), []byte("normal"), []byte("0")})
+	stub.MockInvoke("tx3", [][]byte{[]byte("initParty"), []byte("TaxAuth"), []byte("taxauth"), []byte("0")})
+
+	stub.Creator = fabricatedIdentity(t, "Org1MSP", "A", map[string]string{})
+	payload := `[{"from":"A","to":"B","amount":-100,"clientTxId":"batch-tx-1"}]`
+	res := stub.MockInvoke("tx4", [][]byte{[]byte("batchTransfer"), []byte(payload)})
+	if res.Status == shim.OK {
+		t.Fatalf("expected batchTransfer to reject a leg with a non-positive amount rather than draining the receiver")
+	}
+}